@@ -0,0 +1,138 @@
+package bicache
+
+import (
+	"sync"
+
+	"github.com/jamiealquiza/bicache/sll"
+)
+
+// loadCall represents an in-flight GetOrLoad invocation.
+// Concurrent callers for the same key wait on wg and share
+// its result, so concurrent misses on a key run the loader
+// only once.
+type loadCall struct {
+	wg     sync.WaitGroup
+	charge int
+	err    error
+}
+
+// Handle pins a cache entry in place for as long as the
+// caller holds it. While any Handle for a key is outstanding,
+// PromoteEvict will not free the entry; an eviction attempt
+// instead marks it condemned and defers removal until the
+// last outstanding Handle calls Release.
+type Handle struct {
+	b    *Bicache
+	key  interface{}
+	node *sll.Node
+}
+
+// Value returns the value wrapped by the handle.
+func (h *Handle) Value() interface{} {
+	return h.node.Value.([2]interface{})[1]
+}
+
+// Release drops this handle's reference on the underlying
+// entry. When the last outstanding handle on a condemned
+// entry is released, the entry is finally removed.
+func (h *Handle) Release() {
+	h.b.Lock()
+	defer h.b.Unlock()
+
+	e, ok := h.b.cacheMap[h.key]
+	if !ok || e.node != h.node {
+		return
+	}
+
+	e.refCount--
+	if e.refCount <= 0 && e.condemned {
+		value := e.node.Value.([2]interface{})[1]
+		h.b.unlinkEntry(h.key, e)
+		h.b.notifyEvict(h.key, value, e.condemnReason)
+	}
+}
+
+// GetOrLoad returns a *Handle for key, pinning its entry so it
+// cannot be evicted while the handle is outstanding. On a
+// cache miss, loader is invoked to produce the value and its
+// charge; concurrent callers racing on the same missing key
+// coalesce onto a single loader invocation.
+func (b *Bicache) GetOrLoad(key interface{}, loader func() (value interface{}, charge int, err error)) (*Handle, error) {
+	b.Lock()
+
+	if e, ok := b.cacheMap[key]; ok && e.state != 2 {
+		e.refCount++
+		node := e.node
+		b.Unlock()
+		return &Handle{b: b, key: key, node: node}, nil
+	}
+
+	if call, inFlight := b.loaders[key]; inFlight {
+		b.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return nil, call.err
+		}
+		return b.GetOrLoad(key, loader)
+	}
+
+	call := &loadCall{}
+	call.wg.Add(1)
+	b.loaders[key] = call
+	b.Unlock()
+
+	value, charge, err := loader()
+	call.charge, call.err = charge, err
+	call.wg.Done()
+
+	b.Lock()
+	delete(b.loaders, key)
+	if err != nil {
+		b.Unlock()
+		return nil, err
+	}
+
+	// Another caller may have loaded and inserted key while
+	// we held no lock; prefer its entry over inserting twice.
+	// Otherwise, key may be sitting in 2Q/ARC ghost state from
+	// a prior eviction — consult and clear it the same way Set
+	// does, so we don't leave a stale ghost node pointing at a
+	// cacheMap slot we're about to overwrite.
+	e, ok := b.cacheMap[key]
+	switch {
+	case ok && e.state != 2:
+		e.refCount++
+		node := e.node
+		b.Unlock()
+		return &Handle{b: b, key: key, node: node}, nil
+
+	case ok && e.state == 2:
+		// 2Q ghost hit: promote straight into the MFU, the
+		// same as Set, skipping the MRU entirely.
+		b.ghostCache.Remove(e.node)
+		node := &sll.Node{Value: [2]interface{}{key, value}}
+		b.mfuCache.PushHeadNode(node)
+		b.cacheMap[key] = &entry{node: node, state: 1, charge: charge, refCount: 1}
+		b.mfuCharge += uint(charge)
+		b.Unlock()
+		return &Handle{b: b, key: key, node: node}, nil
+
+	default:
+		if b.adaptive {
+			if _, inB1 := b.b1Map[key]; inB1 {
+				b.arcAdjustP(1)
+				b.removeGhost(b.b1Cache, b.b1Map, key)
+			} else if _, inB2 := b.b2Map[key]; inB2 {
+				b.arcAdjustP(-1)
+				b.removeGhost(b.b2Cache, b.b2Map, key)
+			}
+		}
+
+		node := &sll.Node{Value: [2]interface{}{key, value}}
+		b.mruCache.PushHeadNode(node)
+		b.cacheMap[key] = &entry{node: node, state: 0, charge: charge, refCount: 1}
+		b.mruCharge += uint(charge)
+		b.Unlock()
+		return &Handle{b: b, key: key, node: node}, nil
+	}
+}
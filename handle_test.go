@@ -0,0 +1,85 @@
+package bicache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestGetOrLoadCoalescesConcurrentLoaders asserts that
+// concurrent GetOrLoad calls racing on the same missing key
+// share a single loader invocation.
+func TestGetOrLoadCoalescesConcurrentLoaders(t *testing.T) {
+	b := New(&Config{MfuSize: 4, MruSize: 4})
+
+	var calls int32
+	loader := func() (interface{}, int, error) {
+		atomic.AddInt32(&calls, 1)
+		return "value", 1, nil
+	}
+
+	var wg sync.WaitGroup
+	handles := make([]*Handle, 8)
+	for i := range handles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h, err := b.GetOrLoad("a", loader)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			handles[i] = h
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected loader to run exactly once, ran %d times", calls)
+	}
+
+	for _, h := range handles {
+		if h == nil || h.Value() != "value" {
+			t.Errorf("expected every caller to get a handle to the loaded value")
+		}
+	}
+
+	for _, h := range handles {
+		h.Release()
+	}
+}
+
+// TestGetOrLoadSurvivesGhostHit asserts that GetOrLoad on a key
+// currently sitting in 2Q ghost state clears the ghost entry
+// and inserts a live entry, rather than clobbering cacheMap
+// while leaving the stale ghost node pointing at it.
+func TestGetOrLoadSurvivesGhostHit(t *testing.T) {
+	b := New(&Config{MfuSize: 4, MruSize: 4})
+
+	b.Set("a", 1)
+	b.unlinkEntry("a", b.cacheMap["a"])
+	b.pushToGhost("a")
+
+	if e := b.cacheMap["a"]; e.state != 2 {
+		t.Fatalf("expected key to be a 2Q ghost entry, got state %d", e.state)
+	}
+
+	h, err := b.GetOrLoad("a", func() (interface{}, int, error) {
+		return "loaded", 1, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Release()
+
+	e, ok := b.cacheMap["a"]
+	if !ok {
+		t.Fatal("expected key to be present after GetOrLoad on a ghost hit")
+	}
+	if e.state != 1 {
+		t.Errorf("expected key to be promoted straight to the MFU, got state %d", e.state)
+	}
+	if h.Value() != "loaded" {
+		t.Errorf("expected handle to wrap the loaded value, got %v", h.Value())
+	}
+}
@@ -0,0 +1,134 @@
+package bicache
+
+import "github.com/jamiealquiza/bicache/sll"
+
+// Invalidation describes a batch of keys that should be
+// removed from the cache, or a request to flush everything
+// when All is set.
+type Invalidation struct {
+	Keys []interface{}
+	All  bool
+}
+
+// Invalidator is implemented by external notifiers (e.g. a
+// Postgres LISTEN/NOTIFY feed or message bus subscription)
+// that tell Bicache when its backing store has changed.
+type Invalidator interface {
+	Notifications() <-chan Invalidation
+	Close() error
+}
+
+// watchInvalidator ranges over inv's notifications for the
+// life of the cache, applying each one to b. Only used when b
+// is a standalone Bicache; a ShardedBicache instead routes
+// each notification to its shards itself, since a shared
+// Invalidator's channel would otherwise deliver any given
+// notification to one random shard.
+func (b *Bicache) watchInvalidator(inv Invalidator) {
+	for n := range inv.Notifications() {
+		b.applyInvalidation(n)
+	}
+
+	b.recordReconnectError()
+}
+
+// applyInvalidation removes n's listed keys (or flushes
+// everything on an All notification) under b.Lock(). A pinned
+// key is condemned, the same as Delete, rather than yanked out
+// from under its outstanding Handle; condemnReason is
+// ReasonInvalidated either way, so Config.OnEvict still fires
+// once the last Handle is released.
+func (b *Bicache) applyInvalidation(n Invalidation) {
+	b.Lock()
+	defer b.Unlock()
+
+	if n.All {
+		b.flushLocked()
+		return
+	}
+
+	for _, key := range n.Keys {
+		e, ok := b.cacheMap[key]
+		if !ok || e.state == 2 {
+			b.invalidationMisses++
+			continue
+		}
+
+		if e.refCount > 0 {
+			e.condemned = true
+			e.condemnReason = ReasonInvalidated
+			b.invalidationHits++
+			continue
+		}
+
+		value := e.node.Value.([2]interface{})[1]
+		b.unlinkEntry(key, e)
+		b.notifyEvict(key, value, ReasonInvalidated)
+		b.invalidationHits++
+	}
+}
+
+// recordReconnectError counts an Invalidator notification
+// channel closing, so operators can alert on staleness.
+func (b *Bicache) recordReconnectError() {
+	b.Lock()
+	b.reconnectErrors++
+	b.Unlock()
+}
+
+// flushLocked empties the cache, including ARC/2Q ghost
+// state, calling Config.OnEvict with ReasonInvalidated for
+// each live entry. b must already be locked.
+func (b *Bicache) flushLocked() {
+	for key, e := range b.cacheMap {
+		if e.state != 2 {
+			b.notifyEvict(key, e.node.Value.([2]interface{})[1], ReasonInvalidated)
+		}
+	}
+
+	b.cacheMap = make(map[interface{}]*entry)
+	b.mfuCache = sll.New()
+	b.mruCache = sll.New()
+	b.mfuCharge = 0
+	b.mruCharge = 0
+	b.ghostCache = sll.New()
+
+	if b.adaptive {
+		b.b1Cache = sll.New()
+		b.b2Cache = sll.New()
+		b.b1Map = make(map[interface{}]*sll.Node)
+		b.b2Map = make(map[interface{}]*sll.Node)
+	}
+}
+
+// ChannelInvalidator is a trivial Invalidator backed by an
+// unbuffered channel, useful for tests and for wiring up
+// arbitrary DB triggers or message bus consumers that don't
+// need anything more elaborate.
+type ChannelInvalidator struct {
+	ch chan Invalidation
+}
+
+// NewChannelInvalidator returns a ready-to-use
+// *ChannelInvalidator. Callers push invalidations via Send
+// and must call Close when done.
+func NewChannelInvalidator() *ChannelInvalidator {
+	return &ChannelInvalidator{ch: make(chan Invalidation)}
+}
+
+// Send delivers an invalidation to whichever Bicache is
+// watching this invalidator.
+func (c *ChannelInvalidator) Send(i Invalidation) {
+	c.ch <- i
+}
+
+// Notifications implements Invalidator.
+func (c *ChannelInvalidator) Notifications() <-chan Invalidation {
+	return c.ch
+}
+
+// Close implements Invalidator.
+func (c *ChannelInvalidator) Close() error {
+	close(c.ch)
+	return nil
+}
@@ -0,0 +1,131 @@
+package bicache
+
+import (
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it reports true or a short deadline
+// passes, for asserting on state updated by a background
+// goroutine (e.g. watchInvalidator) without a fixed sleep.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("timed out waiting for condition")
+}
+
+// TestChannelInvalidatorRemovesKey asserts that a notification
+// sent through a ChannelInvalidator removes the named key from
+// the cache and counts an invalidation hit.
+func TestChannelInvalidatorRemovesKey(t *testing.T) {
+	inv := NewChannelInvalidator()
+	defer inv.Close()
+
+	b := New(&Config{MfuSize: 4, MruSize: 4, Invalidator: inv})
+
+	b.Set("a", 1)
+	b.Set("b", 2)
+
+	inv.Send(Invalidation{Keys: []interface{}{"a"}})
+
+	waitFor(t, func() bool {
+		b.RLock()
+		_, ok := b.cacheMap["a"]
+		b.RUnlock()
+		return !ok
+	})
+
+	b.RLock()
+	_, stillHasB := b.cacheMap["b"]
+	hits := b.invalidationHits
+	b.RUnlock()
+
+	if !stillHasB {
+		t.Error("expected invalidation to only remove the named key")
+	}
+	if hits != 1 {
+		t.Errorf("expected 1 invalidation hit, got %d", hits)
+	}
+}
+
+// TestChannelInvalidatorCondemnsPinnedKey asserts that
+// invalidating a key with an outstanding Handle condemns it
+// in place instead of yanking it out from under the handle,
+// and that Config.OnEvict still fires with ReasonInvalidated
+// once the handle is released.
+func TestChannelInvalidatorCondemnsPinnedKey(t *testing.T) {
+	inv := NewChannelInvalidator()
+	defer inv.Close()
+
+	var evictedKey interface{}
+	var evictedReason EvictReason
+
+	b := New(&Config{
+		MfuSize:     4,
+		MruSize:     4,
+		Invalidator: inv,
+		OnEvict: func(key, value interface{}, reason EvictReason) {
+			evictedKey = key
+			evictedReason = reason
+		},
+	})
+
+	h, err := b.GetOrLoad("pinned", func() (interface{}, int, error) {
+		return "value", 1, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	inv.Send(Invalidation{Keys: []interface{}{"pinned"}})
+
+	waitFor(t, func() bool {
+		b.RLock()
+		e, ok := b.cacheMap["pinned"]
+		condemned := ok && e.condemned
+		b.RUnlock()
+		return condemned
+	})
+
+	b.RLock()
+	_, stillPresent := b.cacheMap["pinned"]
+	b.RUnlock()
+	if !stillPresent {
+		t.Fatal("expected the pinned entry to remain resident until its handle is released")
+	}
+
+	h.Release()
+
+	if evictedKey != "pinned" || evictedReason != ReasonInvalidated {
+		t.Errorf("expected OnEvict(\"pinned\", _, ReasonInvalidated), got OnEvict(%v, _, %v)", evictedKey, evictedReason)
+	}
+}
+
+// TestChannelInvalidatorAllFlushesCache asserts that an All
+// notification empties the cache entirely.
+func TestChannelInvalidatorAllFlushesCache(t *testing.T) {
+	inv := NewChannelInvalidator()
+	defer inv.Close()
+
+	b := New(&Config{MfuSize: 4, MruSize: 4, Invalidator: inv})
+
+	b.Set("a", 1)
+	b.Set("b", 2)
+
+	inv.Send(Invalidation{All: true})
+
+	waitFor(t, func() bool {
+		b.RLock()
+		n := len(b.cacheMap)
+		b.RUnlock()
+		return n == 0
+	})
+}
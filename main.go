@@ -22,7 +22,6 @@
 package bicache
 
 import (
-	"fmt"
 	"sort"
 	"sync"
 	"time"
@@ -47,20 +46,101 @@ type Bicache struct {
 	mruCap    uint
 	autoEvict bool
 	// MFU top/bottom scores.
+
+	// ARC adaptive sizing. adaptive enables the ARC
+	// eviction path in place of the scored promotion
+	// in PromoteEvict. p is the current target size
+	// of the MRU (T1) partition, tunable within
+	// [0, arcCap]. b1Cache/b2Cache are ghost lists
+	// holding only the keys of items recently evicted
+	// from the MRU and MFU, respectively.
+	adaptive bool
+	p        uint
+	arcCap   uint
+	b1Cache  *sll.Sll
+	b2Cache  *sll.Sll
+	b1Map    map[interface{}]*sll.Node
+	b2Map    map[interface{}]*sll.Node
+
+	// 2Q ghost tracking. ghostCache holds just the keys
+	// of items recently evicted from the MRU, sized to
+	// ghostCap. A key found here on Set is promoted
+	// directly into the MFU, skipping the MRU, which
+	// keeps a one-shot scan from evicting warm MFU entries.
+	ghostCache *sll.Sll
+	ghostCap   uint
+
+	// mruCharge/mfuCharge are the sum of entry.charge
+	// currently held in the MRU and MFU, checked against
+	// mruCap/mfuCap instead of key counts so that Set
+	// (charge 1) and GetOrLoad (caller-supplied charge)
+	// can share one capacity accounting scheme.
+	mruCharge uint
+	mfuCharge uint
+
+	// loaders tracks in-flight GetOrLoad calls so that
+	// concurrent callers racing on the same missing key
+	// coalesce onto a single loader invocation.
+	loaders map[interface{}]*loadCall
+
+	// defaultTTL is applied by SetWithTTL when called with
+	// a zero ttl. onEvict, if set, is notified whenever an
+	// entry leaves the cache.
+	defaultTTL time.Duration
+	onEvict    func(key, value interface{}, reason EvictReason)
+
+	// invalidator, when configured, drives external cache
+	// invalidation (e.g. a DB LISTEN/NOTIFY feed). The
+	// counters track how effective it's being: hits are
+	// listed keys removed (or condemned, if pinned), misses
+	// are invalidated keys
+	// that were already absent, and reconnectErrors counts
+	// times its notification channel closed.
+	invalidator        Invalidator
+	invalidationHits   uint64
+	invalidationMisses uint64
+	reconnectErrors    uint64
 }
 
 // Config holds a Bicache configuration.
-// The MFU and MRU cache sizes are set in number
-// of keys. The AutoEvict setting specifies an
+// The MFU and MRU cache sizes are set in total
+// charge rather than key count: a plain Set
+// counts as charge 1, while GetOrLoad lets the
+// caller assign a charge per entry (e.g. decoded
+// block size) so variable-sized values can be
+// capacity-planned accurately. The AutoEvict setting specifies an
 // interval in milliseconds that a background
 // goroutine will handle MRU->MFU promotion
 // and MFU/MRU evictions. Setting this to 0
 // defers the operation until each Set is called
 // on the bicache.
+// Adaptive enables ARC-style adaptive sizing
+// between the MRU and MFU partitions instead of
+// the fixed MfuSize/MruSize split normally
+// enforced by PromoteEvict.
+// GhostRatio sizes the 2Q ghost list as a fraction
+// of MruSize and defaults to 0.5 when unset.
+// DefaultTTL, if set, is the expiration applied by SetWithTTL
+// when called with a zero ttl. OnEvict, if set, is called
+// whenever an entry leaves the cache, whether from capacity
+// pressure, TTL expiration, an explicit Delete, or an
+// Invalidator notification.
+// Invalidator, if set, is watched for external invalidation
+// notifications (e.g. a backing store's change feed) for as
+// long as the Bicache is in use.
+// Shards is only used by NewSharded; it sets the shard count,
+// defaulting to runtime.GOMAXPROCS(0)*2 rounded up to the
+// next power of two.
 type Config struct {
-	MfuSize   uint
-	MruSize   uint
-	AutoEvict uint
+	MfuSize     uint
+	MruSize     uint
+	AutoEvict   uint
+	Adaptive    bool
+	GhostRatio  float64
+	DefaultTTL  time.Duration
+	OnEvict     func(key, value interface{}, reason EvictReason)
+	Invalidator Invalidator
+	Shards      uint
 }
 
 // Entry is a container type for scored
@@ -68,17 +148,29 @@ type Config struct {
 // in the Bicache cache map and are used to
 // locate which cache a lookup should hit.
 type entry struct {
-	node  *sll.Node
-	state uint8 // 0 = MRU, 1 = MFU
+	node          *sll.Node
+	state         uint8 // 0 = MRU, 1 = MFU, 2 = ghost (2Q)
+	charge        int   // Capacity units this entry counts for. Defaults to 1 for Set.
+	refCount      int   // Outstanding Handles from GetOrLoad.
+	condemned     bool  // Evicted while pinned; removed on last Handle.Release.
+	condemnReason EvictReason
+	expiresAt     time.Time // Zero if the entry has no TTL.
 }
 
 // Stats holds Bicache
 // statistics data.
 type Stats struct {
-	MfuSize  uint // Number of acive MFU keys.
-	MruSize  uint // Number of active MRU keys.
+	MfuSize  uint // MFU charge in use.
+	MruSize  uint // MRU charge in use.
 	MfuUsedP uint // MFU used in percent.
 	MruUsedP uint // MRU used in percent.
+	P        uint // ARC target MRU size. Only set when Config.Adaptive is true.
+	B1Size   uint // Ghost list size for MRU evictions. Only set when Config.Adaptive is true.
+	B2Size   uint // Ghost list size for MFU evictions. Only set when Config.Adaptive is true.
+
+	InvalidationHits   uint64 // Invalidated keys that were removed, or condemned if pinned. An All flush is not counted.
+	InvalidationMisses uint64 // Invalidated keys that were already absent.
+	ReconnectErrors    uint64 // Times the Invalidator's notification channel closed.
 }
 
 // New takes a *Config and returns
@@ -90,8 +182,33 @@ func New(c *Config) *Bicache {
 		mruCache: sll.New(),
 		mfuCap:   c.MfuSize,
 		mruCap:   c.MruSize,
+		loaders:  make(map[interface{}]*loadCall),
+
+		defaultTTL: c.DefaultTTL,
+		onEvict:    c.OnEvict,
 	}
 
+	if c.Invalidator != nil {
+		cache.invalidator = c.Invalidator
+		go cache.watchInvalidator(c.Invalidator)
+	}
+
+	if c.Adaptive {
+		cache.adaptive = true
+		cache.arcCap = c.MfuSize + c.MruSize
+		cache.b1Cache = sll.New()
+		cache.b2Cache = sll.New()
+		cache.b1Map = make(map[interface{}]*sll.Node)
+		cache.b2Map = make(map[interface{}]*sll.Node)
+	}
+
+	ghostRatio := c.GhostRatio
+	if ghostRatio == 0 {
+		ghostRatio = 0.5
+	}
+	cache.ghostCache = sll.New()
+	cache.ghostCap = uint(float64(c.MruSize) * ghostRatio)
+
 	if c.AutoEvict > 0 {
 		cache.autoEvict = true
 		go func(b *Bicache) {
@@ -99,6 +216,7 @@ func New(c *Config) *Bicache {
 			defer interval.Stop()
 
 			for _ = range interval.C {
+				b.expireSweep()
 				b.PromoteEvict()
 			}
 		}(cache)
@@ -111,134 +229,383 @@ func New(c *Config) *Bicache {
 // Bicache statistics data.
 func (b *Bicache) Stats() *Stats {
 	b.RLock()
-	stats := &Stats{MfuSize: b.mfuCache.Len(), MruSize: b.mruCache.Len()}
+	stats := &Stats{MfuSize: b.mfuCharge, MruSize: b.mruCharge}
 	b.RUnlock()
 
 	stats.MfuUsedP = uint(float64(stats.MfuSize) / float64(b.mfuCap) * 100)
 	stats.MruUsedP = uint(float64(stats.MruSize) / float64(b.mruCap) * 100)
 
+	if b.adaptive {
+		b.RLock()
+		stats.P = b.p
+		stats.B1Size = b.b1Cache.Len()
+		stats.B2Size = b.b2Cache.Len()
+		b.RUnlock()
+	}
+
+	if b.invalidator != nil {
+		b.RLock()
+		stats.InvalidationHits = b.invalidationHits
+		stats.InvalidationMisses = b.invalidationMisses
+		stats.ReconnectErrors = b.reconnectErrors
+		b.RUnlock()
+	}
+
 	return stats
 }
 
-// PromoteEvict checks if the MRU exceeds the
-// Config.MruSize. If so, the top MRU scores are
-// checked against the MFU. If any of the top MRU scores
-// are greater than the lowest MFU scores, they are promoted
-// to the MFU (if possible). Any remaining count of evictions
-// that must occur are removed from the tail of the MRU.
-func (b *Bicache) PromoteEvict() {
+// Get looks up key in the cache map and, if found, bumps its
+// score. In adaptive (ARC) mode, a hit on a T1 (MRU) entry is
+// a second reference to that key, so it is promoted straight
+// into T2 (MFU) rather than merely moved to the MRU head;
+// a T2 hit just moves to the MFU head. Outside of adaptive
+// mode, a hit moves to the head of whichever list (MRU or
+// MFU) currently holds the entry. A key currently in 2Q or
+// ARC ghost state is a miss: its node only holds the bare
+// key, not a value, so Get must not treat it as a hit.
+func (b *Bicache) Get(key interface{}) interface{} {
 	b.Lock()
 	defer b.Unlock()
 
-	// How far over MRU capacity are we?
-	mruOverflow := int(b.mruCache.Len() - b.mruCap)
-	if mruOverflow <= 0 {
-		return
+	e, ok := b.cacheMap[key]
+	if !ok || e.state == 2 {
+		return nil
 	}
 
-	// Get the top n MRU elements
-	// where n = MRU capacity overflow.
-	topMru := b.mruCache.HighScores(mruOverflow)
-	// Put into ascending order.
-	sort.Sort(sort.Reverse(topMru))
+	e.node.Score++
 
-	// Check MFU capacity.
-	mfuFree := b.mfuCap - b.mfuCache.Len()
-
-	// Promote what we can.
-	// canPromote is the count of mruOverflow
-	// that can fit into currently unused MFU slots.
-	// This is only likely to be met if this
-	// is a somewhat new cache.
-	var canPromote int
-	if int(mfuFree) >= mruOverflow {
-		canPromote = mruOverflow
-	} else {
-		canPromote = int(mfuFree)
-	}
-
-	var start *sll.Node
-	// If the MFU is already full,
-	// we can skip the next block.
-	if mfuFree == 0 {
-		goto promoteByScore
-	}
-
-	// This is all MRU->MFU promotion
-	// using free slots.
-	if canPromote > 0 {
-		for _, node := range topMru[:canPromote] {
-			// We have to do this because
-			// performing a Remove and PushToTail
-			// with the same node is difficult.
-			newNode := &sll.Node{}
-			*newNode = *node
-			// Need to update the state.
-			b.cacheMap[node.Value.([2]interface{})[0]].state = 1
-			b.cacheMap[node.Value.([2]interface{})[0]].node = newNode
-			// Copy to MFU.
-			b.mfuCache.PushTailNode(newNode)
-			// Remove from the MRU.
-			b.mruCache.Remove(node)
-		}
+	switch {
+	case b.adaptive && e.state == 0:
+		newNode := &sll.Node{}
+		*newNode = *e.node
+		b.mruCache.Remove(e.node)
+		b.mruCharge -= uint(e.charge)
+		b.mfuCache.PushHeadNode(newNode)
+		b.mfuCharge += uint(e.charge)
+		e.node = newNode
+		e.state = 1
+	case e.state == 0:
+		b.mruCache.MoveToHead(e.node)
+	default:
+		b.mfuCache.MoveToHead(e.node)
+	}
+
+	return e.node.Value.([2]interface{})[1]
+}
+
+// Set inserts or updates key with value. New keys are
+// inserted into the MRU, except a key still recorded in the
+// 2Q ghost list, which goes straight into the MFU; existing
+// keys have their value updated in place. If adaptive sizing
+// is enabled and key is present in one of the ARC ghost
+// lists, p is adjusted and the ghost entry is cleared before
+// the key is reinserted. When Config.AutoEvict is 0, Set runs
+// PromoteEvict after releasing the lock.
+func (b *Bicache) Set(key, value interface{}) {
+	if !b.autoEvict {
+		// Deferred first, so it runs after the Unlock below.
+		defer b.PromoteEvict()
+	}
 
-		// If we were able to promote
-		// all the overflow, return. 
-		if canPromote == len(topMru) {
+	b.Lock()
+	defer b.Unlock()
+
+	if e, ok := b.cacheMap[key]; ok {
+		if e.state == 2 {
+			// 2Q ghost hit: promote straight into the
+			// MFU, skipping the MRU entirely.
+			b.ghostCache.Remove(e.node)
+			node := &sll.Node{Value: [2]interface{}{key, value}}
+			b.mfuCache.PushHeadNode(node)
+			b.cacheMap[key] = &entry{node: node, state: 1, charge: 1}
+			b.mfuCharge++
 			return
 		}
+
+		e.node.Value = [2]interface{}{key, value}
+		return
 	}
 
-promoteByScore:
+	if b.adaptive {
+		if _, inB1 := b.b1Map[key]; inB1 {
+			b.arcAdjustP(1)
+			b.removeGhost(b.b1Cache, b.b1Map, key)
+		} else if _, inB2 := b.b2Map[key]; inB2 {
+			b.arcAdjustP(-1)
+			b.removeGhost(b.b2Cache, b.b2Map, key)
+		}
+	}
 
-	start = b.mruCache.Tail()
-	fmt.Println("[mru]")
-	for {
-		fmt.Printf("%d:%d -> ", start.Value.([2]interface{})[1], start.Score)
-		if start.Next != nil {
-			start = start.Next
+	node := &sll.Node{Value: [2]interface{}{key, value}}
+	b.mruCache.PushHeadNode(node)
+	b.cacheMap[key] = &entry{node: node, state: 0, charge: 1}
+	b.mruCharge++
+}
+
+// unlinkEntry removes key's entry from cacheMap and whichever
+// list currently holds it, adjusting the matching charge sum.
+func (b *Bicache) unlinkEntry(key interface{}, e *entry) {
+	switch e.state {
+	case 0:
+		b.mruCache.Remove(e.node)
+		b.mruCharge -= uint(e.charge)
+	case 1:
+		b.mfuCache.Remove(e.node)
+		b.mfuCharge -= uint(e.charge)
+	}
+	delete(b.cacheMap, key)
+}
+
+// evictOrCondemn removes key's entry if it has no outstanding
+// Handles. A pinned entry (refCount > 0) is instead marked
+// condemned so the last Handle.Release removes it, and this
+// eviction attempt reports false so the caller skips any
+// post-eviction bookkeeping (e.g. ghost list insertion).
+func (b *Bicache) evictOrCondemn(key interface{}) bool {
+	e, ok := b.cacheMap[key]
+	if !ok {
+		return false
+	}
+
+	if e.refCount > 0 {
+		e.condemned = true
+		e.condemnReason = ReasonCapacity
+		return false
+	}
+
+	value := e.node.Value.([2]interface{})[1]
+	b.unlinkEntry(key, e)
+	b.notifyEvict(key, value, ReasonCapacity)
+	return true
+}
+
+// notifyEvict calls Config.OnEvict, if set.
+func (b *Bicache) notifyEvict(key, value interface{}, reason EvictReason) {
+	if b.onEvict != nil {
+		b.onEvict(key, value, reason)
+	}
+}
+
+// Delete explicitly removes key from the cache. A pinned
+// entry is condemned, as with capacity eviction, and removed
+// once its last outstanding Handle is released.
+func (b *Bicache) Delete(key interface{}) {
+	b.Lock()
+	defer b.Unlock()
+
+	e, ok := b.cacheMap[key]
+	if !ok || e.state == 2 {
+		return
+	}
+
+	if e.refCount > 0 {
+		e.condemned = true
+		e.condemnReason = ReasonExplicit
+		return
+	}
+
+	value := e.node.Value.([2]interface{})[1]
+	b.unlinkEntry(key, e)
+	b.notifyEvict(key, value, ReasonExplicit)
+}
+
+// arcAdjustP grows or shrinks the ARC target MRU size p in
+// response to a ghost list hit. direction 1 (a B1 hit)
+// grows p, giving the MRU (T1) a larger target; direction -1
+// (a B2 hit) shrinks p in favor of the MFU (T2). p is clamped
+// to [0, arcCap].
+func (b *Bicache) arcAdjustP(direction int) {
+	b1 := b.b1Cache.Len()
+	b2 := b.b2Cache.Len()
+
+	switch direction {
+	case 1:
+		delta := uint(1)
+		if b1 > 0 && b2/b1 > 1 {
+			delta = b2 / b1
+		}
+		b.p += delta
+	case -1:
+		delta := uint(1)
+		if b2 > 0 && b1/b2 > 1 {
+			delta = b1 / b2
+		}
+		if delta > b.p {
+			b.p = 0
 		} else {
-			break
+			b.p -= delta
 		}
 	}
-	fmt.Println()
-	start = b.mfuCache.Tail()
-	fmt.Println("[mfu]")
-	for {
-		fmt.Printf("%d:%d -> ", start.Value.([2]interface{})[1], start.Score)
-		if start.Next != nil {
-			start = start.Next
-		} else {
-			break
+
+	if b.p > b.arcCap {
+		b.p = b.arcCap
+	}
+}
+
+// arcEvict implements the ARC replacement step: evict from
+// the MRU (T1) tail if it has grown to at least the target
+// size p, otherwise evict from the MFU (T2) tail. The
+// evicted key is moved to the matching ghost list, which is
+// trimmed to arcCap entries. It loops until the cache is back
+// under arcCap: whichever list is over its share always has
+// an eviction branch available, so a lopsided p (e.g. grown
+// past the current MRU charge while the MFU is still empty)
+// can't leave both branches false and stall eviction. If the
+// preferred list's tail is pinned, evictFromTail walks past it
+// toward the head for the next evictable entry instead of
+// giving up, and if every entry in that list is pinned, the
+// other list is tried before the sweep gives up for this tick.
+func (b *Bicache) arcEvict() {
+	for b.mruCharge+b.mfuCharge > b.arcCap {
+		mruFirst := b.mruCache.Len() > 0 && (b.mruCharge >= b.p || b.mfuCache.Len() == 0)
+
+		if mruFirst {
+			if b.evictFromTail(b.mruCache, b.b1Cache, b.b1Map) {
+				continue
+			}
+			if b.evictFromTail(b.mfuCache, b.b2Cache, b.b2Map) {
+				continue
+			}
+		} else if b.mfuCache.Len() > 0 {
+			if b.evictFromTail(b.mfuCache, b.b2Cache, b.b2Map) {
+				continue
+			}
+			if b.evictFromTail(b.mruCache, b.b1Cache, b.b1Map) {
+				continue
+			}
+		}
+
+		return
+	}
+}
+
+// evictFromTail evicts the least-recently-used unpinned entry
+// in list, starting at its tail and walking toward the head
+// past any pinned (outstanding-Handle) entries, which are
+// condemned in place rather than evicted. The evicted key is
+// moved into the given ghost list. It reports whether an entry
+// was evicted; false means every entry in list is currently
+// pinned, so the caller should fall back to the other list
+// instead of stalling.
+func (b *Bicache) evictFromTail(list *sll.Sll, ghost *sll.Sll, ghostMap map[interface{}]*sll.Node) bool {
+	if list.Len() == 0 {
+		return false
+	}
+
+	for node := list.Tail(); node != nil; node = node.Next() {
+		key := node.Value.([2]interface{})[0]
+		if !b.evictOrCondemn(key) {
+			continue
 		}
+		b.pushGhost(ghost, ghostMap, key)
+		return true
 	}
-	fmt.Println()
 
-	// We're here on two conditions:
-	// 1) The MFU was full. We need to handle all topMru (canPromote == 0).
-	// 2) We promoted some topMru and have leftovers (canPromote > 0).
+	return false
+}
 
-	// Get top MRU scores and bottom MFU scores to compare.
-	bottomMfu := b.mfuCache.LowScores(len(topMru[canPromote:]))
+// pushGhost records key in the given ghost list, trimming
+// the list tail down to arcCap entries.
+func (b *Bicache) pushGhost(list *sll.Sll, m map[interface{}]*sll.Node, key interface{}) {
+	node := &sll.Node{Value: key}
+	list.PushHeadNode(node)
+	m[key] = node
 
-	// If the lowest MFU score is higher than the lowest
-	// score to promote, none of these are eligible.
-	if bottomMfu[0].Score > topMru[canPromote].Score {
-		fmt.Println("max score not high enough")
-		goto evictFromTail
+	for list.Len() > b.arcCap {
+		tail := list.Tail()
+		delete(m, tail.Value)
+		list.Remove(tail)
 	}
+}
 
-	// Otherwise, scan for a replacement.
-	for _, n := range topMru[canPromote:] {
-		i := sort.Search(len(bottomMfu), func(i int) bool {
-				return bottomMfu[i].Score >= n.Score 
-			})
-		fmt.Println(i)
+// removeGhost drops key from the given ghost list, if present.
+func (b *Bicache) removeGhost(list *sll.Sll, m map[interface{}]*sll.Node, key interface{}) {
+	if node, ok := m[key]; ok {
+		list.Remove(node)
+		delete(m, key)
 	}
-	
-evictFromTail:
-	// Evict remainder from MRU tail.
-	fmt.Println("evict from tail")
-	fmt.Println()
+}
 
+// pushToGhost records an MRU eviction's key in the 2Q ghost
+// list and in cacheMap with state 2, so a subsequent Set can
+// detect the ghost hit and promote straight into the MFU.
+// The ghost list is trimmed to ghostCap entries.
+func (b *Bicache) pushToGhost(key interface{}) {
+	node := &sll.Node{Value: key}
+	b.ghostCache.PushHeadNode(node)
+	b.cacheMap[key] = &entry{node: node, state: 2}
+
+	for b.ghostCache.Len() > b.ghostCap {
+		tail := b.ghostCache.Tail()
+		delete(b.cacheMap, tail.Value)
+		b.ghostCache.Remove(tail)
+	}
+}
+
+// PromoteEvict checks if the MRU exceeds the
+// Config.MruSize charge budget. If so, the top-scored MRU
+// entries are walked in order and promoted into the MFU
+// while its charge budget allows; anything left over is
+// evicted from the MRU tail into the 2Q ghost list.
+func (b *Bicache) PromoteEvict() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.adaptive {
+		b.arcEvict()
+		return
+	}
+
+	// How far over MRU capacity are we, in charge.
+	mruOverflow := int(b.mruCharge) - int(b.mruCap)
+	if mruOverflow <= 0 {
+		return
+	}
+
+	// Highest-scored MRU nodes, most-promotable first.
+	topMru := b.mruCache.HighScores(int(b.mruCache.Len()))
+	sort.Sort(sort.Reverse(topMru))
+
+	// Promote what fits in the MFU's remaining charge budget.
+	// promoted is how many leading entries of topMru were
+	// promoted, so the rest is exactly what's left to evict;
+	// unlike a node count, it can never exceed len(topMru).
+	mfuFree := int(b.mfuCap) - int(b.mfuCharge)
+
+	var promoted int
+	for _, node := range topMru {
+		key := node.Value.([2]interface{})[0]
+		e := b.cacheMap[key]
+
+		if e.charge > mfuFree {
+			break
+		}
+
+		// We have to do this because
+		// performing a Remove and PushToTail
+		// with the same node is difficult.
+		newNode := &sll.Node{}
+		*newNode = *node
+		// Need to update the state.
+		e.state = 1
+		e.node = newNode
+		// Copy to MFU.
+		b.mfuCache.PushTailNode(newNode)
+		// Remove from the MRU.
+		b.mruCache.Remove(node)
+		b.mruCharge -= uint(e.charge)
+		b.mfuCharge += uint(e.charge)
+
+		mfuFree -= e.charge
+		promoted++
+	}
+
+	// Evict whatever didn't fit in the MFU from the MRU tail.
+	for _, n := range topMru[promoted:] {
+		key := n.Value.([2]interface{})[0]
+		if !b.evictOrCondemn(key) {
+			continue
+		}
+		b.pushToGhost(key)
+	}
 }
@@ -0,0 +1,132 @@
+package bicache
+
+import "testing"
+
+// TestGetPromotesAdaptiveT1ToT2 asserts that, in adaptive (ARC)
+// mode, a second Get on a key still sitting in the MRU (T1)
+// promotes it into the MFU (T2) rather than merely moving it
+// to the MRU head.
+func TestGetPromotesAdaptiveT1ToT2(t *testing.T) {
+	b := New(&Config{MfuSize: 4, MruSize: 4, Adaptive: true})
+
+	b.Set("a", 1)
+
+	if e := b.cacheMap["a"]; e.state != 0 {
+		t.Fatalf("expected key to start in the MRU, got state %d", e.state)
+	}
+
+	b.Get("a")
+
+	e := b.cacheMap["a"]
+	if e.state != 1 {
+		t.Errorf("expected key to be promoted to the MFU on a second reference, got state %d", e.state)
+	}
+	if b.mfuCharge != 1 {
+		t.Errorf("expected mfuCharge 1 after promotion, got %d", b.mfuCharge)
+	}
+	if b.mruCharge != 0 {
+		t.Errorf("expected mruCharge 0 after promotion, got %d", b.mruCharge)
+	}
+}
+
+// TestSetPromotesGhostHitToMfu asserts that Set on a key
+// still recorded in the 2Q ghost list promotes it straight
+// into the MFU, skipping the MRU, and clears the ghost entry.
+func TestSetPromotesGhostHitToMfu(t *testing.T) {
+	b := New(&Config{MfuSize: 4, MruSize: 4})
+
+	b.Set("a", 1)
+	b.unlinkEntry("a", b.cacheMap["a"])
+	b.pushToGhost("a")
+
+	if e := b.cacheMap["a"]; e.state != 2 {
+		t.Fatalf("expected key to be a 2Q ghost entry, got state %d", e.state)
+	}
+
+	b.Set("a", 2)
+
+	e, ok := b.cacheMap["a"]
+	if !ok {
+		t.Fatal("expected key to be present after Set on a ghost hit")
+	}
+	if e.state != 1 {
+		t.Errorf("expected key to be promoted straight to the MFU, got state %d", e.state)
+	}
+	if b.mfuCharge != 1 {
+		t.Errorf("expected mfuCharge 1 after promotion, got %d", b.mfuCharge)
+	}
+	if b.mruCharge != 0 {
+		t.Errorf("expected mruCharge 0, key should have skipped the MRU, got %d", b.mruCharge)
+	}
+}
+
+// TestGetMissesOnGhostEntry asserts that Get on a key
+// currently sitting in 2Q ghost state reports a miss instead
+// of panicking: a ghost node's Value is the bare key, not a
+// [2]interface{}{key, value} tuple, so Get must not treat
+// state == 2 as a live MRU/MFU hit.
+func TestGetMissesOnGhostEntry(t *testing.T) {
+	b := New(&Config{MfuSize: 4, MruSize: 4})
+
+	b.Set("a", 1)
+	b.unlinkEntry("a", b.cacheMap["a"])
+	b.pushToGhost("a")
+
+	if got := b.Get("a"); got != nil {
+		t.Errorf("expected Get on a ghost entry to return nil, got %v", got)
+	}
+}
+
+// TestArcEvictDoesNotStall asserts that arcEvict keeps evicting
+// until back under arcCap even once p has grown past the
+// current MRU charge while the MFU is still empty, a
+// combination that previously left both eviction branches
+// false and stalled eviction indefinitely.
+func TestArcEvictDoesNotStall(t *testing.T) {
+	b := New(&Config{MfuSize: 2, MruSize: 2, Adaptive: true})
+
+	b.Set("a", 1)
+	b.Set("b", 2)
+	// Past the MRU charge of 5 that the Sets below reach.
+	b.p = b.arcCap + 2
+
+	b.Set("c", 3)
+	b.Set("d", 4)
+	b.Set("e", 5)
+	b.PromoteEvict()
+
+	if b.mruCharge+b.mfuCharge > b.arcCap {
+		t.Fatalf("expected arcEvict to keep the cache at or under capacity, got mruCharge=%d mfuCharge=%d arcCap=%d", b.mruCharge, b.mfuCharge, b.arcCap)
+	}
+}
+
+// TestArcEvictSkipsPinnedTailForOtherCandidates asserts that a
+// pinned entry sitting at the natural eviction position doesn't
+// stall the whole sweep: arcEvict must keep trying other
+// candidates, and the other list, rather than returning as soon
+// as the first eviction attempt hits a pinned entry.
+func TestArcEvictSkipsPinnedTailForOtherCandidates(t *testing.T) {
+	b := New(&Config{MfuSize: 2, MruSize: 2, Adaptive: true})
+
+	h, err := b.GetOrLoad("pinned", func() (interface{}, int, error) {
+		return "value", 1, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer h.Release()
+
+	b.Set("a", 1)
+	b.Set("b", 2)
+	b.Set("c", 3)
+	b.Set("d", 4)
+
+	b.PromoteEvict()
+
+	if b.mruCharge+b.mfuCharge > b.arcCap {
+		t.Errorf("expected the unpinned entries to be evicted despite the pinned tail, got mruCharge=%d mfuCharge=%d arcCap=%d", b.mruCharge, b.mfuCharge, b.arcCap)
+	}
+	if _, ok := b.cacheMap["pinned"]; !ok {
+		t.Error("expected the pinned entry to remain resident (condemned, not evicted)")
+	}
+}
@@ -0,0 +1,165 @@
+package bicache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+)
+
+// Cache is the surface shared by Bicache and ShardedBicache,
+// so callers can switch between a single cache and a sharded
+// one without changing call sites.
+type Cache interface {
+	Get(key interface{}) interface{}
+	Set(key, value interface{})
+	Delete(key interface{})
+	Stats() *Stats
+}
+
+var (
+	_ Cache = (*Bicache)(nil)
+	_ Cache = (*ShardedBicache)(nil)
+)
+
+// ShardedBicache fans keys out across N independent *Bicache
+// shards by fnv.New64a(key), so write-heavy workloads aren't
+// serialized through one Bicache's RWMutex.
+type ShardedBicache struct {
+	shards []*Bicache
+	mask   uint64
+}
+
+// NewSharded takes a *Config and returns an initialized
+// *ShardedBicache. Config.Shards sets the shard count,
+// defaulting to runtime.GOMAXPROCS(0)*2 rounded up to the
+// next power of two. Each shard is built from a copy of c
+// with MfuSize/MruSize divided by the shard count.
+//
+// A configured Config.Invalidator is not handed to the
+// per-shard New() calls: its Notifications() channel has
+// single-consumer-per-message semantics, so if every shard
+// watched it directly, any given notification would land on
+// one random shard instead of all of them. Instead NewSharded
+// runs a single watcher that applies each listed key to the
+// shard that owns it, and an All notification to every shard.
+func NewSharded(c *Config) *ShardedBicache {
+	n := nextPowerOfTwo(c.Shards)
+
+	shardConfig := *c
+	shardConfig.Shards = 0
+	shardConfig.Invalidator = nil
+	shardConfig.MfuSize = c.MfuSize / n
+	shardConfig.MruSize = c.MruSize / n
+
+	sb := &ShardedBicache{
+		shards: make([]*Bicache, n),
+		mask:   uint64(n - 1),
+	}
+
+	for i := range sb.shards {
+		cfg := shardConfig
+		sb.shards[i] = New(&cfg)
+
+		// Record the Invalidator on the shard itself so its
+		// Stats() reports real invalidation counters, even
+		// though New() was given a nil Invalidator and so
+		// never started a per-shard watchInvalidator goroutine
+		// for it.
+		sb.shards[i].invalidator = c.Invalidator
+	}
+
+	if c.Invalidator != nil {
+		go sb.watchInvalidator(c.Invalidator)
+	}
+
+	return sb
+}
+
+// watchInvalidator ranges over inv's notifications for the
+// life of the cache. Each listed key goes only to the shard
+// that owns it and an All notification goes to every shard,
+// so the aggregated Stats counts each key, and each channel
+// close, once.
+func (sb *ShardedBicache) watchInvalidator(inv Invalidator) {
+	for n := range inv.Notifications() {
+		if n.All {
+			for _, s := range sb.shards {
+				s.applyInvalidation(n)
+			}
+			continue
+		}
+
+		for _, key := range n.Keys {
+			sb.shardFor(key).applyInvalidation(Invalidation{Keys: []interface{}{key}})
+		}
+	}
+
+	sb.shards[0].recordReconnectError()
+}
+
+// nextPowerOfTwo rounds n up to the next power of two,
+// defaulting to runtime.GOMAXPROCS(0)*2 when n is 0.
+func nextPowerOfTwo(n uint) uint {
+	if n == 0 {
+		n = uint(runtime.GOMAXPROCS(0) * 2)
+	}
+
+	p := uint(1)
+	for p < n {
+		p <<= 1
+	}
+
+	return p
+}
+
+// shardFor returns the shard key belongs on.
+func (sb *ShardedBicache) shardFor(key interface{}) *Bicache {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v", key)
+
+	return sb.shards[h.Sum64()&sb.mask]
+}
+
+// Get implements Cache.
+func (sb *ShardedBicache) Get(key interface{}) interface{} {
+	return sb.shardFor(key).Get(key)
+}
+
+// Set implements Cache.
+func (sb *ShardedBicache) Set(key, value interface{}) {
+	sb.shardFor(key).Set(key, value)
+}
+
+// Delete implements Cache.
+func (sb *ShardedBicache) Delete(key interface{}) {
+	sb.shardFor(key).Delete(key)
+}
+
+// Stats implements Cache, aggregating every shard's *Stats.
+func (sb *ShardedBicache) Stats() *Stats {
+	agg := &Stats{}
+
+	var mfuPSum, mruPSum uint
+	for _, s := range sb.shards {
+		st := s.Stats()
+
+		agg.MfuSize += st.MfuSize
+		agg.MruSize += st.MruSize
+		agg.P += st.P
+		agg.B1Size += st.B1Size
+		agg.B2Size += st.B2Size
+		agg.InvalidationHits += st.InvalidationHits
+		agg.InvalidationMisses += st.InvalidationMisses
+		agg.ReconnectErrors += st.ReconnectErrors
+
+		mfuPSum += st.MfuUsedP
+		mruPSum += st.MruUsedP
+	}
+
+	if n := uint(len(sb.shards)); n > 0 {
+		agg.MfuUsedP = mfuPSum / n
+		agg.MruUsedP = mruPSum / n
+	}
+
+	return agg
+}
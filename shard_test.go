@@ -0,0 +1,65 @@
+package bicache
+
+import "testing"
+
+// TestShardedBicacheRoutesToConsistentShard asserts that a key
+// always routes to the same shard, so a Set followed by a Get
+// lands on the same *Bicache.
+func TestShardedBicacheRoutesToConsistentShard(t *testing.T) {
+	sb := NewSharded(&Config{MfuSize: 4, MruSize: 4, Shards: 4})
+
+	sb.Set("a", 1)
+
+	if got := sb.Get("a"); got != 1 {
+		t.Errorf("expected Get to return the value Set on the same shard, got %v", got)
+	}
+}
+
+// TestShardedBicacheInvalidatorRemovesFromOwningShard asserts
+// that an Invalidation reaches the shard that owns each listed
+// key, so the key is removed whichever shard it lives on - a
+// single shard watching a shared Invalidator channel would
+// only see a fraction of the notifications.
+func TestShardedBicacheInvalidatorRemovesFromOwningShard(t *testing.T) {
+	inv := NewChannelInvalidator()
+	defer inv.Close()
+
+	sb := NewSharded(&Config{MfuSize: 4, MruSize: 4, Shards: 4, Invalidator: inv})
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, k := range keys {
+		sb.Set(k, k)
+	}
+
+	for _, k := range keys {
+		inv.Send(Invalidation{Keys: []interface{}{k}})
+	}
+
+	for _, k := range keys {
+		key := k
+		waitFor(t, func() bool {
+			return sb.Get(key) == nil
+		})
+	}
+}
+
+// TestShardedBicacheStatsReportsInvalidationCounters asserts
+// that Stats() reports real invalidation counters for a
+// ShardedBicache, rather than permanently 0: NewSharded hands
+// each shard's own New() a nil Invalidator (so it doesn't spawn
+// a redundant per-shard watcher), but must still record the
+// Invalidator on each shard directly so Stats() doesn't gate
+// the aggregation on a nil check.
+func TestShardedBicacheStatsReportsInvalidationCounters(t *testing.T) {
+	inv := NewChannelInvalidator()
+	defer inv.Close()
+
+	sb := NewSharded(&Config{MfuSize: 4, MruSize: 4, Shards: 4, Invalidator: inv})
+
+	sb.Set("a", 1)
+	inv.Send(Invalidation{Keys: []interface{}{"a"}})
+
+	waitFor(t, func() bool {
+		return sb.Stats().InvalidationHits > 0
+	})
+}
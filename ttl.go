@@ -0,0 +1,75 @@
+package bicache
+
+import "time"
+
+// EvictReason describes why an entry left the cache, passed
+// to Config.OnEvict.
+type EvictReason uint8
+
+const (
+	// ReasonCapacity means the entry was evicted to make
+	// room under MfuSize/MruSize (or the ARC target size).
+	ReasonCapacity EvictReason = iota
+	// ReasonTTL means the entry's TTL elapsed.
+	ReasonTTL
+	// ReasonExplicit means the entry was removed by Delete.
+	ReasonExplicit
+	// ReasonInvalidated means the entry was removed by an
+	// Invalidator notification.
+	ReasonInvalidated
+)
+
+// SetWithTTL inserts or updates key the same as Set, but the
+// entry additionally expires after ttl. A ttl of 0 falls back
+// to Config.DefaultTTL; if that is also 0, the entry never
+// expires from age alone.
+func (b *Bicache) SetWithTTL(key, value interface{}, ttl time.Duration) {
+	b.Set(key, value)
+
+	if ttl == 0 {
+		ttl = b.defaultTTL
+	}
+
+	b.Lock()
+	if e, ok := b.cacheMap[key]; ok {
+		if ttl > 0 {
+			e.expiresAt = time.Now().Add(ttl)
+		} else {
+			e.expiresAt = time.Time{}
+		}
+	}
+	b.Unlock()
+}
+
+// expireSweep removes any MFU or MRU entries whose TTL has
+// elapsed, notifying Config.OnEvict with ReasonTTL. A pinned
+// entry is condemned instead and removed on its last
+// Handle.Release. Run on each AutoEvict tick, ahead of
+// PromoteEvict.
+func (b *Bicache) expireSweep() {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+
+	var expired []interface{}
+	for key, e := range b.cacheMap {
+		if e.state != 2 && !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			expired = append(expired, key)
+		}
+	}
+
+	for _, key := range expired {
+		e := b.cacheMap[key]
+
+		if e.refCount > 0 {
+			e.condemned = true
+			e.condemnReason = ReasonTTL
+			continue
+		}
+
+		value := e.node.Value.([2]interface{})[1]
+		b.unlinkEntry(key, e)
+		b.notifyEvict(key, value, ReasonTTL)
+	}
+}
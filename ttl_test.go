@@ -0,0 +1,71 @@
+package bicache
+
+import (
+	"testing"
+	"time"
+)
+
+// TestExpireSweepRemovesElapsedEntries asserts that
+// expireSweep removes an entry whose TTL has elapsed and
+// calls Config.OnEvict with ReasonTTL, while leaving an
+// entry with no TTL untouched.
+func TestExpireSweepRemovesElapsedEntries(t *testing.T) {
+	var evictedKey interface{}
+	var evictedReason EvictReason
+
+	b := New(&Config{
+		MfuSize: 4,
+		MruSize: 4,
+		OnEvict: func(key, value interface{}, reason EvictReason) {
+			evictedKey = key
+			evictedReason = reason
+		},
+	})
+
+	b.SetWithTTL("expired", "value", time.Millisecond)
+	b.Set("fresh", "value")
+
+	time.Sleep(5 * time.Millisecond)
+	b.expireSweep()
+
+	if _, ok := b.cacheMap["expired"]; ok {
+		t.Error("expected expired key to be removed by expireSweep")
+	}
+	if _, ok := b.cacheMap["fresh"]; !ok {
+		t.Error("expected key with no TTL to survive expireSweep")
+	}
+	if evictedKey != "expired" || evictedReason != ReasonTTL {
+		t.Errorf("expected OnEvict(\"expired\", _, ReasonTTL), got OnEvict(%v, _, %v)", evictedKey, evictedReason)
+	}
+}
+
+// TestExpireSweepCondemnsPinnedEntry asserts that an expired
+// but pinned (outstanding Handle) entry is condemned rather
+// than removed outright, and is only removed once its last
+// Handle is released.
+func TestExpireSweepCondemnsPinnedEntry(t *testing.T) {
+	b := New(&Config{MfuSize: 4, MruSize: 4})
+
+	h, err := b.GetOrLoad("pinned", func() (interface{}, int, error) {
+		return "value", 1, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b.Lock()
+	b.cacheMap["pinned"].expiresAt = time.Now().Add(-time.Millisecond)
+	b.Unlock()
+
+	b.expireSweep()
+
+	if _, ok := b.cacheMap["pinned"]; !ok {
+		t.Fatal("expected pinned entry to remain until its handle is released")
+	}
+
+	h.Release()
+
+	if _, ok := b.cacheMap["pinned"]; ok {
+		t.Error("expected pinned entry to be removed once its last handle was released")
+	}
+}